@@ -0,0 +1,312 @@
+package block
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// queryBufferSize mirrors index.queryBufferSize. Operator.NextChunk's
+// buffer size must match the array size index.QueryOperator.NextChunk
+// expects; Go interfaces are satisfied structurally, so the two packages
+// only need to agree on the literal, not share an import.
+const queryBufferSize = 128
+
+// Reader provides read-only access to a block written by Writer. The
+// symbol table and posting data are memory-mapped. OpenBlock decodes the
+// whole symbol table and TOC up front; a word's posting data is only read
+// when a query touches it.
+type Reader struct {
+	symbols  []byte
+	postings []byte
+
+	toc            []tocEntry // sorted by symbolOffset
+	symbolByOffset map[uint32]string
+
+	maxID uint64
+
+	docLengthsOffset uint64
+	docLengthsCount  uint32
+}
+
+// OpenBlock mmaps a block directory previously written by Writer and
+// verifies its footer checksum.
+func OpenBlock(dir string) (*Reader, error) {
+	footer, err := os.ReadFile(filepath.Join(dir, footerFileName))
+	if err != nil {
+		return nil, err
+	}
+	if len(footer) < footerSize {
+		return nil, fmt.Errorf("block: %s: truncated footer", dir)
+	}
+	if binary.BigEndian.Uint32(footer[0:4]) != magic {
+		return nil, fmt.Errorf("block: %s: bad magic", dir)
+	}
+	tocOffset := binary.BigEndian.Uint64(footer[4:12])
+	tocCount := binary.BigEndian.Uint32(footer[12:16])
+	wantChecksum := binary.BigEndian.Uint32(footer[16:20])
+	maxID := binary.BigEndian.Uint64(footer[20:28])
+	docLengthsOffset := binary.BigEndian.Uint64(footer[28:36])
+	docLengthsCount := binary.BigEndian.Uint32(footer[36:40])
+
+	symbols, err := mmapFile(filepath.Join(dir, symbolsFileName))
+	if err != nil {
+		return nil, err
+	}
+	postings, err := mmapFile(filepath.Join(dir, postingsFileName))
+	if err != nil {
+		return nil, err
+	}
+	if tocOffset > uint64(len(postings)) {
+		return nil, fmt.Errorf("block: %s: TOC offset out of range", dir)
+	}
+
+	tocBuf := postings[tocOffset:]
+	if gotChecksum := crc32.ChecksumIEEE(tocBuf); gotChecksum != wantChecksum {
+		return nil, fmt.Errorf("block: %s: TOC checksum mismatch", dir)
+	}
+
+	toc := make([]tocEntry, 0, tocCount)
+	for i := uint32(0); i < tocCount; i++ {
+		symbolOffset, n := binary.Uvarint(tocBuf)
+		tocBuf = tocBuf[n:]
+		postingsOffset, n := binary.Uvarint(tocBuf)
+		tocBuf = tocBuf[n:]
+		idsLength, n := binary.Uvarint(tocBuf)
+		tocBuf = tocBuf[n:]
+		posLength, n := binary.Uvarint(tocBuf)
+		tocBuf = tocBuf[n:]
+		toc = append(toc, tocEntry{uint32(symbolOffset), postingsOffset, idsLength, posLength})
+	}
+
+	symbolByOffset := make(map[uint32]string, len(toc))
+	buf := symbols
+	var off uint32
+	for len(buf) > 0 {
+		length, n := binary.Uvarint(buf)
+		word := string(buf[n : uint64(n)+length])
+		symbolByOffset[off] = word
+		buf = buf[uint64(n)+length:]
+		off += uint32(n) + uint32(length)
+	}
+
+	return &Reader{
+		symbols:          symbols,
+		postings:         postings,
+		toc:              toc,
+		symbolByOffset:   symbolByOffset,
+		maxID:            maxID,
+		docLengthsOffset: docLengthsOffset,
+		docLengthsCount:  docLengthsCount,
+	}, nil
+}
+
+// MaxID returns the highest post ID written to this block, or 0 if the
+// block is empty. OpenIndex uses this to restore PostIndex.nextId past
+// whatever the WAL segments covering these posts have since been
+// truncated away.
+func (r *Reader) MaxID() uint64 { return r.maxID }
+
+func mmapFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, nil
+	}
+
+	return syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func (r *Reader) findWord(word string) (tocEntry, bool) {
+	i := sort.Search(len(r.toc), func(i int) bool {
+		return r.symbolByOffset[r.toc[i].symbolOffset] >= word
+	})
+	if i < len(r.toc) && r.symbolByOffset[r.toc[i].symbolOffset] == word {
+		return r.toc[i], true
+	}
+	return tocEntry{}, false
+}
+
+// Query returns an Operator streaming the posting list for word, or nil if
+// this block has no postings for it at all (mirroring the nil *PostChunk
+// that index.PostIndex.findSetChunkForQuery returns for an unknown word).
+//
+// The returned Operator decodes straight out of the mmapped postings
+// section as NextChunk is called; Query itself does no decoding, so
+// querying a word backed by a huge posting list doesn't have to
+// materialize any of it up front.
+func (r *Reader) Query(word string) *Operator {
+	entry, present := r.findWord(word)
+	if !present {
+		return nil
+	}
+
+	data := r.postings[entry.postingsOffset : entry.postingsOffset+entry.idsLength]
+	count, n := binary.Uvarint(data)
+	data = data[n:]
+
+	return &Operator{data: data, remain: int(count)}
+}
+
+// PositionsFor returns the token offsets word occurs at in id's post, or
+// nil if this block has no such posting (either word isn't present in the
+// block at all, or id isn't among the posts word's list covers).
+//
+// Decoding walks the posting list from the front each call rather than
+// binary-searching it: unlike the fixed-size framing CompressedChunk uses
+// for that, individual postings here are variable-length varints, so nothing
+// shorter than a full scan can stop the instant it passes id -- which it
+// does, since ids is known to be strictly descending.
+func (r *Reader) PositionsFor(word string, id uint64) []int32 {
+	entry, present := r.findWord(word)
+	if !present {
+		return nil
+	}
+
+	idsData := r.postings[entry.postingsOffset : entry.postingsOffset+entry.idsLength]
+	count, n := binary.Uvarint(idsData)
+	idsData = idsData[n:]
+
+	posStart := entry.postingsOffset + entry.idsLength
+	posData := r.postings[posStart : posStart+entry.posLength]
+
+	var cur uint64
+	for i := uint64(0); i < count; i++ {
+		if i == 0 {
+			v, n := binary.Uvarint(idsData)
+			idsData = idsData[n:]
+			cur = v
+		} else {
+			delta, n := binary.Uvarint(idsData)
+			idsData = idsData[n:]
+			cur -= delta
+		}
+
+		posCount, n := binary.Uvarint(posData)
+		posData = posData[n:]
+
+		if cur == id {
+			positions := make([]int32, posCount)
+			for j := uint64(0); j < posCount; j++ {
+				v, n := binary.Uvarint(posData)
+				posData = posData[n:]
+				positions[j] = int32(v)
+			}
+			return positions
+		}
+		if cur < id { // ids is strictly descending, so id isn't in this list
+			return nil
+		}
+
+		for j := uint64(0); j < posCount; j++ { // skip past positions we don't need
+			_, n := binary.Uvarint(posData)
+			posData = posData[n:]
+		}
+	}
+	return nil
+}
+
+// PostingCount returns the number of posts in word's posting list, and
+// whether this block has a posting list for word at all. It only reads
+// the list's length prefix, not the list itself.
+func (r *Reader) PostingCount(word string) (int, bool) {
+	entry, present := r.findWord(word)
+	if !present {
+		return 0, false
+	}
+	data := r.postings[entry.postingsOffset : entry.postingsOffset+entry.idsLength]
+	count, _ := binary.Uvarint(data)
+	return int(count), true
+}
+
+// DocCount returns the number of distinct posts this block's doc-length
+// section covers -- every post Snapshot captured when it wrote this
+// block, not just the ones matching any one word.
+func (r *Reader) DocCount() int { return int(r.docLengthsCount) }
+
+// DocLength returns the word count recorded for id, and whether this block
+// has one at all.
+func (r *Reader) DocLength(id uint64) (uint16, bool) {
+	if r.docLengthsCount == 0 {
+		return 0, false
+	}
+
+	data := r.postings[r.docLengthsOffset:]
+	var cur uint64
+	for i := uint32(0); i < r.docLengthsCount; i++ {
+		delta, n := binary.Uvarint(data)
+		data = data[n:]
+		cur += delta
+		length, n := binary.Uvarint(data)
+		data = data[n:]
+
+		if cur == id {
+			return uint16(length), true
+		}
+		if cur > id { // doc lengths is ascending, so id isn't recorded
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// Operator streams a single on-disk posting list straight out of the
+// mmapped block it came from. It implements index.QueryOperator
+// structurally: NextChunk's buffer is the same [128]uint64 shape
+// ParseQuery's terminal operators already use.
+type Operator struct {
+	data   []byte // remaining id payload, not yet decoded
+	remain int    // ids left to decode
+	cur    uint64 // last decoded id
+	first  bool   // whether cur has been set yet
+}
+
+// Uids materializes every remaining ID in this operator's posting list,
+// ignoring nothing but also buffering nothing beyond this one call.
+// index.findOperatorForQuery uses this to wrap a block's postings in a
+// CompressedChunk, the same way it does for a PostSet's sealed chunks, so
+// on-disk operands get LenHint/RandomAccess too instead of only ever
+// being a plain scan.
+func (op *Operator) Uids() []uint64 {
+	ids := make([]uint64, 0, op.remain)
+	var buf [queryBufferSize]uint64
+	for {
+		n := op.NextChunk(&buf)
+		if n == 0 {
+			return ids
+		}
+		ids = append(ids, buf[:n]...)
+	}
+}
+
+func (op *Operator) NextChunk(buffer *[queryBufferSize]uint64) int {
+	i := 0
+	for i < queryBufferSize && op.remain > 0 {
+		if !op.first {
+			v, n := binary.Uvarint(op.data)
+			op.data = op.data[n:]
+			op.cur = v
+			op.first = true
+		} else {
+			delta, n := binary.Uvarint(op.data)
+			op.data = op.data[n:]
+			op.cur -= delta
+		}
+		buffer[i] = op.cur
+		op.remain--
+		i++
+	}
+	return i
+}
@@ -0,0 +1,299 @@
+// Package block implements an immutable, on-disk representation of a
+// PostIndex, modeled loosely on the Prometheus TSDB index format: a Writer
+// produces a directory of flat files once, and a Reader mmaps them for
+// read-only, zero-copy access. Neither side ever mutates the bytes after
+// Close/OpenBlock returns.
+package block
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	symbolsFileName  = "symbols"
+	postingsFileName = "postings"
+	footerFileName   = "footer"
+
+	magic      uint32 = 0x676f6978 // "goix"
+	footerSize        = 48
+)
+
+// footer layout (all integers big-endian):
+//
+//	[0:4]   magic
+//	[4:12]  TOC offset within postings
+//	[12:16] TOC entry count
+//	[16:20] CRC32 of the TOC
+//	[20:28] maxID: the highest post ID written to this block, so
+//	        PostIndex.OpenIndex can restore nextId past whatever the WAL
+//	        segments covering these posts had already been truncated away.
+//	[28:36] doc-lengths section offset within postings
+//	[36:40] doc-lengths entry count
+//	[40:48] reserved for future footer fields
+
+type tocEntry struct {
+	symbolOffset   uint32
+	postingsOffset uint64
+	idsLength      uint64 // length, in bytes, of the ID section starting at postingsOffset
+	posLength      uint64 // length, in bytes, of the positions section immediately following it
+}
+
+// Writer builds a single on-disk block. Callers must call AddSymbols
+// exactly once, then AddPostingList for each word (any order), then
+// AddDocLengths, then Close. AddSymbols and AddDocLengths panic if called
+// more than once, and AddPostingList panics if called before AddSymbols;
+// no other ordering is checked.
+type Writer struct {
+	dir string
+
+	symbols    *os.File
+	symbolsBuf *bufio.Writer
+	symbolOff  map[string]uint32
+	haveSyms   bool
+
+	postings    *os.File
+	postingsBuf *bufio.Writer
+	postingsOff uint64
+	toc         []tocEntry
+
+	maxID uint64
+
+	docLengthsOffset uint64
+	docLengthsCount  uint32
+	haveDocLengths   bool
+}
+
+func NewWriter(dir string) (*Writer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	symbols, err := os.Create(filepath.Join(dir, symbolsFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	postings, err := os.Create(filepath.Join(dir, postingsFileName))
+	if err != nil {
+		symbols.Close()
+		return nil, err
+	}
+
+	return &Writer{
+		dir:         dir,
+		symbols:     symbols,
+		symbolsBuf:  bufio.NewWriter(symbols),
+		postings:    postings,
+		postingsBuf: bufio.NewWriter(postings),
+	}, nil
+}
+
+// AddSymbols writes the deduplicated vocabulary as a sorted, length-prefixed
+// string table. It must be called exactly once, before any AddPostingList
+// call, because posting lists are keyed by symbol offset rather than by the
+// word itself.
+func (w *Writer) AddSymbols(words map[string]struct{}) error {
+	if w.haveSyms {
+		panic("block: AddSymbols called more than once")
+	}
+	w.haveSyms = true
+
+	sorted := make([]string, 0, len(words))
+	for word := range words {
+		sorted = append(sorted, word)
+	}
+	sort.Strings(sorted)
+
+	w.symbolOff = make(map[string]uint32, len(sorted))
+	var off uint32
+	var scratch [binary.MaxVarintLen64]byte
+	for _, word := range sorted {
+		w.symbolOff[word] = off
+
+		n := binary.PutUvarint(scratch[:], uint64(len(word)))
+		if _, err := w.symbolsBuf.Write(scratch[:n]); err != nil {
+			return err
+		}
+		if _, err := w.symbolsBuf.WriteString(word); err != nil {
+			return err
+		}
+		off += uint32(n) + uint32(len(word))
+	}
+
+	return nil
+}
+
+// AddPostingList writes a delta+varint-compressed posting list for word,
+// followed immediately by the token positions PhraseOperator and BM25
+// scoring need for each of those IDs.
+//
+// ids must be in the same descending order the in-memory PostSet chunk
+// chain produces; the first ID is stored absolute and every one after it
+// as a delta from its predecessor, which Reader streams straight back out
+// in descending order with no buffering or reversal required, since a
+// descending sequence's successive differences are already positive.
+//
+// positions[i] is the token offsets recorded for ids[i] (the same value
+// index.positionsFor(word, ids[i]) would return live) -- nil is written
+// as a zero-length list, which PhraseOperator treats the same as "word
+// not present in this post".
+func (w *Writer) AddPostingList(word string, ids []uint64, positions [][]int32) error {
+	if !w.haveSyms {
+		panic("block: AddPostingList called before AddSymbols")
+	}
+	if len(positions) != len(ids) {
+		panic("block: positions must have one entry per id")
+	}
+
+	symbolOffset, present := w.symbolOff[word]
+	if !present {
+		return fmt.Errorf("block: word %q was not passed to AddSymbols", word)
+	}
+
+	if len(ids) > 0 && ids[0] > w.maxID { // ids is descending, so ids[0] is its max
+		w.maxID = ids[0]
+	}
+
+	start := w.postingsOff
+	var scratch [binary.MaxVarintLen64]byte
+
+	n := binary.PutUvarint(scratch[:], uint64(len(ids)))
+	if err := w.writePostings(scratch[:n]); err != nil {
+		return err
+	}
+
+	var prev uint64
+	for i, id := range ids {
+		var v uint64
+		if i == 0 {
+			v = id
+		} else {
+			v = prev - id // positive: ids is strictly descending
+		}
+		prev = id
+
+		n := binary.PutUvarint(scratch[:], v)
+		if err := w.writePostings(scratch[:n]); err != nil {
+			return err
+		}
+	}
+	idsLength := w.postingsOff - start
+
+	for _, p := range positions {
+		n := binary.PutUvarint(scratch[:], uint64(len(p)))
+		if err := w.writePostings(scratch[:n]); err != nil {
+			return err
+		}
+		for _, pos := range p {
+			n := binary.PutUvarint(scratch[:], uint64(pos))
+			if err := w.writePostings(scratch[:n]); err != nil {
+				return err
+			}
+		}
+	}
+
+	w.toc = append(w.toc, tocEntry{symbolOffset, start, idsLength, w.postingsOff - start - idsLength})
+	return nil
+}
+
+// AddDocLengths writes the per-ID word count BM25 needs for length
+// normalization, for every post this block's posting lists cover. It must
+// be called exactly once, after every AddPostingList call, since a block
+// doesn't otherwise carry the full set of IDs it contains until then.
+func (w *Writer) AddDocLengths(lengths map[uint64]uint16) error {
+	if w.haveDocLengths {
+		panic("block: AddDocLengths called more than once")
+	}
+	w.haveDocLengths = true
+
+	ids := make([]uint64, 0, len(lengths))
+	for id := range lengths {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	w.docLengthsOffset = w.postingsOff
+	w.docLengthsCount = uint32(len(ids))
+
+	var scratch [binary.MaxVarintLen64]byte
+	var prev uint64
+	for _, id := range ids {
+		n := binary.PutUvarint(scratch[:], id-prev) // ascending: id-prev is the delta, absolute for the first entry (prev == 0)
+		if err := w.writePostings(scratch[:n]); err != nil {
+			return err
+		}
+		prev = id
+
+		n = binary.PutUvarint(scratch[:], uint64(lengths[id]))
+		if err := w.writePostings(scratch[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writePostings(b []byte) error {
+	n, err := w.postingsBuf.Write(b)
+	w.postingsOff += uint64(n)
+	return err
+}
+
+// Close finalizes the block: it flushes the symbol table, writes the
+// word->postings TOC after the posting data, and writes a footer recording
+// the offsets of each section plus a CRC32 checksum of the TOC.
+func (w *Writer) Close() error {
+	if err := w.symbolsBuf.Flush(); err != nil {
+		return err
+	}
+
+	sort.Slice(w.toc, func(i, j int) bool { return w.toc[i].symbolOffset < w.toc[j].symbolOffset })
+
+	tocOffset := w.postingsOff
+	var scratch [binary.MaxVarintLen64]byte
+	tocBuf := make([]byte, 0, len(w.toc)*4*binary.MaxVarintLen64)
+	for _, e := range w.toc {
+		n := binary.PutUvarint(scratch[:], uint64(e.symbolOffset))
+		tocBuf = append(tocBuf, scratch[:n]...)
+		n = binary.PutUvarint(scratch[:], e.postingsOffset)
+		tocBuf = append(tocBuf, scratch[:n]...)
+		n = binary.PutUvarint(scratch[:], e.idsLength)
+		tocBuf = append(tocBuf, scratch[:n]...)
+		n = binary.PutUvarint(scratch[:], e.posLength)
+		tocBuf = append(tocBuf, scratch[:n]...)
+	}
+	if err := w.writePostings(tocBuf); err != nil {
+		return err
+	}
+	if err := w.postingsBuf.Flush(); err != nil {
+		return err
+	}
+
+	footer, err := os.Create(filepath.Join(w.dir, footerFileName))
+	if err != nil {
+		return err
+	}
+	defer footer.Close()
+
+	var header [footerSize]byte
+	binary.BigEndian.PutUint32(header[0:4], magic)
+	binary.BigEndian.PutUint64(header[4:12], tocOffset)
+	binary.BigEndian.PutUint32(header[12:16], uint32(len(w.toc)))
+	binary.BigEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(tocBuf))
+	binary.BigEndian.PutUint64(header[20:28], w.maxID)
+	binary.BigEndian.PutUint64(header[28:36], w.docLengthsOffset)
+	binary.BigEndian.PutUint32(header[36:40], w.docLengthsCount)
+	if _, err := footer.Write(header[:]); err != nil {
+		return err
+	}
+
+	if err := w.symbols.Close(); err != nil {
+		return err
+	}
+	return w.postings.Close()
+}
@@ -0,0 +1,161 @@
+package index
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+const compressedBlockSize = 128
+
+// CompressedChunk is a delta+varint-packed encoding of a posting list,
+// split into blocks of up to compressedBlockSize IDs. It's meant for
+// chunks that are done growing -- PostSet only ever appends to its newest
+// PostChunk, so once one is full it never changes again and is a good
+// candidate for compaction into one of these. Each block records its own
+// minimum ID (the list stays in the descending order the rest of the
+// index relies on, so a block's *last* ID is its smallest) so Contains
+// and Seek can jump straight to the one block that might hold a given ID
+// instead of scanning from the front.
+type CompressedChunk struct {
+	count     int
+	blockMins []uint64 // one per block, descending
+	blocks    [][]byte // one packed, delta-encoded payload per block
+}
+
+// NewCompressedChunk packs ids, which must already be in descending order
+// (the order PostSet.ids and TerminalOperator both produce), into a
+// CompressedChunk.
+func NewCompressedChunk(ids []uint64) *CompressedChunk {
+	c := &CompressedChunk{count: len(ids)}
+
+	var scratch [binary.MaxVarintLen64]byte
+	for start := 0; start < len(ids); start += compressedBlockSize {
+		end := start + compressedBlockSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		block := ids[start:end]
+
+		var buf []byte
+		prev := block[0]
+		n := binary.PutUvarint(scratch[:], uint64(prev))
+		buf = append(buf, scratch[:n]...)
+		for _, id := range block[1:] {
+			n := binary.PutUvarint(scratch[:], uint64(prev-id)) // descending, so prev >= id
+			buf = append(buf, scratch[:n]...)
+			prev = id
+		}
+
+		c.blocks = append(c.blocks, buf)
+		c.blockMins = append(c.blockMins, block[len(block)-1])
+	}
+
+	return c
+}
+
+// ExactLen is O(1) -- the count is stored at construction time, not
+// recomputed -- which is what lets AndOperator decide between a linear
+// merge and a binary-search probe without materializing either side.
+func (c *CompressedChunk) ExactLen() int { return c.count }
+
+func decodeCompressedBlock(buf []byte) []uint64 {
+	ids := make([]uint64, 0, compressedBlockSize)
+	first, n := binary.Uvarint(buf)
+	buf = buf[n:]
+	prev := uint64(first)
+	ids = append(ids, prev)
+	for len(buf) > 0 {
+		delta, n := binary.Uvarint(buf)
+		buf = buf[n:]
+		prev -= uint64(delta)
+		ids = append(ids, prev)
+	}
+	return ids
+}
+
+// Contains reports whether id is present, binary-searching blockMins for
+// the one block that could hold it before falling back to an in-block
+// scan. It's the fast path AndOperator uses when one operand is much
+// larger than the other.
+func (c *CompressedChunk) Contains(id uint64) bool {
+	i := sort.Search(len(c.blockMins), func(i int) bool { return c.blockMins[i] <= id })
+	if i >= len(c.blockMins) {
+		return false
+	}
+	for _, v := range decodeCompressedBlock(c.blocks[i]) {
+		if v == id {
+			return true
+		}
+		if v < id {
+			return false
+		}
+	}
+	return false
+}
+
+// NewDecoder returns a Decoder streaming c's IDs from the start.
+func (c *CompressedChunk) NewDecoder() *Decoder {
+	return &Decoder{chunk: c}
+}
+
+// Decoder streams a CompressedChunk queryBufferSize elements at a time, so
+// it implements QueryOperator the same way TerminalOperator does. It also
+// implements LenHint and RandomAccess, which is what lets AndOperator
+// choose the binary-search intersection path instead of a linear merge.
+type Decoder struct {
+	chunk      *CompressedChunk
+	blockIndex int      // index of the next block to decode
+	block      []uint64 // the currently decoded block, nil until first touched
+	pos        int
+}
+
+func (d *Decoder) ExactLen() int { return d.chunk.ExactLen() }
+
+func (d *Decoder) Contains(id uint64) bool { return d.chunk.Contains(id) }
+
+// Uids materializes every ID in the underlying chunk, ignoring the
+// decoder's current position.
+func (d *Decoder) Uids() []uint64 {
+	ids := make([]uint64, 0, d.chunk.count)
+	for _, block := range d.chunk.blocks {
+		ids = append(ids, decodeCompressedBlock(block)...)
+	}
+	return ids
+}
+
+// Seek advances the decoder to the first block whose minimum ID is <=
+// target, decodes it, and returns whether it found one. It lets a caller
+// skip whole blocks instead of scanning one ID at a time to get close to
+// a target.
+func (d *Decoder) Seek(target uint64) bool {
+	for d.blockIndex < len(d.chunk.blocks) && d.chunk.blockMins[d.blockIndex] > target {
+		d.blockIndex++
+	}
+	if d.blockIndex >= len(d.chunk.blocks) {
+		d.block = nil
+		return false
+	}
+
+	d.block = decodeCompressedBlock(d.chunk.blocks[d.blockIndex])
+	d.blockIndex++
+	d.pos = 0
+	return true
+}
+
+func (d *Decoder) NextChunk(buffer *[queryBufferSize]uint64) int {
+	i := 0
+	for i < queryBufferSize {
+		if d.block == nil || d.pos >= len(d.block) {
+			if d.blockIndex >= len(d.chunk.blocks) {
+				break
+			}
+			d.block = decodeCompressedBlock(d.chunk.blocks[d.blockIndex])
+			d.blockIndex++
+			d.pos = 0
+		}
+		buffer[i] = d.block[d.pos]
+		d.pos++
+		i++
+	}
+	return i
+}
@@ -4,12 +4,14 @@ import (
 	"sort"
 	"sync"
 	"sync/atomic"
+
+	"github.com/DeCarabas/goindex/index/block"
 )
 
 const ChunkSize int32 = 4096
 
 type PostChunk struct {
-	IDs    [ChunkSize]uint32
+	IDs    [ChunkSize]uint64
 	Length int32
 	Next   *PostChunk
 }
@@ -17,6 +19,19 @@ type PostChunk struct {
 type PostSet struct {
 	firstChunk atomic.Value
 	SyncRoot   sync.Mutex
+
+	// docFreq is the number of posts containing this set's word. It's
+	// kept in sync with AddPost/compact rather than recomputed by summing
+	// chunk lengths every time QueryPostsScored needs IDF.
+	docFreq int32
+
+	// sealedCompressed caches a CompressedChunk covering every ID in
+	// firstChunk.Next and beyond -- the part of the chain that's done
+	// growing, since firstChunk is the only chunk AddPost ever appends
+	// to. It's rebuilt whenever another chunk seals (see resealCompressed)
+	// and lets findOperatorForQuery stream the sealed part of the chain
+	// through a Decoder instead of walking every chunk.
+	sealedCompressed atomic.Value // *CompressedChunk
 }
 
 func NewPostSet() *PostSet {
@@ -25,43 +40,167 @@ func NewPostSet() *PostSet {
 	return r
 }
 
-func (set *PostSet) AddPost(id uint32) {
+func (set *PostSet) AddPost(id uint64) {
 	firstChunk := set.FirstChunk()
 	if firstChunk.Length == ChunkSize {
-		target := &PostChunk{[ChunkSize]uint32{0: id}, 1, firstChunk}
+		target := &PostChunk{[ChunkSize]uint64{0: id}, 1, firstChunk}
 		set.firstChunk.Store(target)
+		set.resealCompressed(target)
 	} else {
 		firstChunk.IDs[firstChunk.Length] = id
 		atomic.AddInt32(&firstChunk.Length, 1)
 	}
+	atomic.AddInt32(&set.docFreq, 1)
+}
+
+// resealCompressed rebuilds sealedCompressed by walking newHead.Next
+// onward -- every chunk that's sealed so far, now that newHead just
+// superseded the last of them as firstChunk. Callers must hold
+// SyncRoot, same as AddPost itself, since it's only ever called from
+// AddPost and compact.
+func (set *PostSet) resealCompressed(newHead *PostChunk) {
+	var ids []uint64
+	for c := newHead.Next; c != nil; c = c.Next {
+		for i := c.Length - 1; i >= 0; i-- {
+			ids = append(ids, c.IDs[i])
+		}
+	}
+
+	var compressed *CompressedChunk
+	if len(ids) > 0 {
+		compressed = NewCompressedChunk(ids)
+	}
+	set.sealedCompressed.Store(compressed)
+}
+
+// SealedCompressed returns the CompressedChunk covering every ID sealed
+// so far (everything but the live, still-growing head chunk), or nil if
+// nothing has sealed yet.
+func (set *PostSet) SealedCompressed() *CompressedChunk {
+	v := set.sealedCompressed.Load()
+	if v == nil {
+		return nil
+	}
+	return v.(*CompressedChunk)
+}
+
+// DocFreq returns the number of live posts containing this set's word.
+func (set *PostSet) DocFreq() int32 {
+	return atomic.LoadInt32(&set.docFreq)
 }
 
 func (set *PostSet) FirstChunk() *PostChunk {
 	return set.firstChunk.Load().(*PostChunk)
 }
 
+// ids returns every ID in the set, newest first, by walking the chunk
+// chain the same way TerminalOperator.NextChunk does. It's only used to
+// snapshot a set to disk, so it doesn't need to be as cheap as the query
+// path.
+func (set *PostSet) ids() []uint64 {
+	var result []uint64
+	for chunk := set.FirstChunk(); chunk != nil; chunk = chunk.Next {
+		for i := chunk.Length - 1; i >= 0; i-- {
+			result = append(result, chunk.IDs[i])
+		}
+	}
+	return result
+}
+
+// compact rewrites the chunk chain in place, dropping every ID index has
+// tombstoned. Callers must hold set.SyncRoot so this never races AddPost.
+func (set *PostSet) compact(index *PostIndex) {
+	kept := set.ids() // newest first
+	filtered := kept[:0]
+	for _, id := range kept {
+		if !index.isTombstoned(id) {
+			filtered = append(filtered, id)
+		}
+	}
+
+	rebuilt := &PostChunk{}
+	for i := len(filtered) - 1; i >= 0; i-- { // filtered is newest-first; replay oldest-first to rebuild
+		if rebuilt.Length == ChunkSize {
+			rebuilt = &PostChunk{[ChunkSize]uint64{0: filtered[i]}, 1, rebuilt}
+		} else {
+			rebuilt.IDs[rebuilt.Length] = filtered[i]
+			rebuilt.Length++
+		}
+	}
+	set.firstChunk.Store(rebuilt)
+	set.resealCompressed(rebuilt)
+	atomic.StoreInt32(&set.docFreq, int32(len(filtered)))
+}
+
 type PostIndex struct {
-	nextLocalId int32
-	setsLock    sync.RWMutex
-	sets        map[string]*PostSet
-	idMapLock   sync.RWMutex
-	idMap       map[uint32]uint64
+	nextId   int64
+	setsLock sync.RWMutex
+	sets     map[string]*PostSet
+
+	// blocksLock guards blocks, the immutable on-disk blocks produced by
+	// past calls to Snapshot. A query mixes these in with the live, mutable
+	// sets above so that ParseQuery never has to know whether a term's
+	// matches came from disk or from memory.
+	blocksLock sync.RWMutex
+	blocks     []*block.Reader
+
+	// tombstoneLock guards tombstones, a sorted list of IDs that
+	// DeletePost has removed. We can't drop an ID from its PostSet chunk
+	// chain in place -- that chain relies on IDs only ever being appended
+	// in ascending order -- so deletion is deferred: ParseQuery filters
+	// tombstoned IDs out of every query, and Compact is the offline path
+	// that actually rewrites the chunk chains and clears this list.
+	tombstoneLock sync.RWMutex
+	tombstones    []uint64
+
+	// wal is non-nil only for indexes opened with OpenIndex. AddPost and
+	// DeletePost write through to it before touching sets/tombstones so a
+	// crash can be replayed back to the same state.
+	wal *WAL
+
+	// positionsLock guards positions, the token offsets PhraseOperator
+	// needs to tell "all these words are present" apart from "these words
+	// are present and adjacent, in order". Keyed by word, then by ID,
+	// since that's how PhraseOperator looks them up -- one word's posting
+	// list at a time, for whichever ID survived the AND merge. It
+	// doubles as term-frequency storage for BM25 scoring: the number of
+	// positions recorded for (word, id) is that term's count in that
+	// post, so QueryPostsScored doesn't need a second per-(word,doc)
+	// counter alongside it.
+	positionsLock sync.RWMutex
+	positions     map[string]map[uint64][]int32
+
+	// docLengthsLock guards docLengths, the per-ID word count BM25 needs
+	// for length normalization, indexed by id-1 since IDs are assigned
+	// densely starting at 1. totalDocLen and docCount track the running
+	// sum and count so avgDocLen doesn't have to rescan docLengths.
+	docLengthsLock sync.RWMutex
+	docLengths     []uint16
+	totalDocLen    int64
+	docCount       int64
 }
 
-func (index *PostIndex) findSetChunkForQuery(word string) *PostChunk {
+func (index *PostIndex) findSetForQuery(word string) *PostSet {
 	index.setsLock.RLock()
 	defer index.setsLock.RUnlock()
 
 	if index.sets == nil {
 		return nil
 	}
+	return index.sets[word]
+}
 
-	set, present := index.sets[word]
-	if present {
-		return set.FirstChunk()
-	} else {
-		return nil
+// dedupeSortedWords collapses adjacent duplicates in sortedWords, which
+// must already be sorted, in place. A post that repeats a word (e.g. "the
+// cat and the dog") would otherwise resolve to the same *PostSet twice.
+func dedupeSortedWords(sortedWords []string) []string {
+	out := sortedWords[:0]
+	for i, w := range sortedWords {
+		if i == 0 || w != sortedWords[i-1] {
+			out = append(out, w)
+		}
 	}
+	return out
 }
 
 func (index *PostIndex) findOrCreateSets(sortedWords []string) []*PostSet {
@@ -112,23 +251,71 @@ func (index *PostIndex) findOrCreateSets(sortedWords []string) []*PostSet {
 	return sets
 }
 
-func (index *PostIndex) addIdMapping(globalId uint64, localId uint32) {
-	// NOTE: Access to the ID map is currently protected by a mutex; this is
-	// not great. Perhaps we need something fancier? Like channels and
-	// goroutines and the like? That would let us at least add
-	// asynchronously, but it still serializes the readers, which is where we
-	// need the most performance...
-	//
-	index.idMapLock.Lock()
-	defer index.idMapLock.Unlock()
+// addPositions records, for each word in words, the token offset(s) it
+// occurs at in id's post, so PhraseOperator can later tell adjacency apart
+// from mere co-occurrence.
+func (index *PostIndex) addPositions(id uint64, words []string) {
+	index.positionsLock.Lock()
+	defer index.positionsLock.Unlock()
 
-	if index.idMap == nil {
-		index.idMap = make(map[uint32]uint64)
+	if index.positions == nil {
+		index.positions = make(map[string]map[uint64][]int32)
+	}
+	for i, word := range words {
+		byId := index.positions[word]
+		if byId == nil {
+			byId = make(map[uint64][]int32)
+			index.positions[word] = byId
+		}
+		byId[id] = append(byId[id], int32(i))
+	}
+}
+
+// positionsFor returns the token offsets word occurs at in id's post. If
+// id's own AddPost call happened in this process, or was replayed from a
+// WAL segment still on disk, that's a live lookup; otherwise id's position
+// data only survives inside whichever on-disk block Snapshot last wrote
+// it to, so every block is checked in turn.
+func (index *PostIndex) positionsFor(word string, id uint64) []int32 {
+	index.positionsLock.RLock()
+	var live []int32
+	if index.positions != nil {
+		live = index.positions[word][id]
+	}
+	index.positionsLock.RUnlock()
+	if live != nil {
+		return live
+	}
+
+	index.blocksLock.RLock()
+	blocks := index.blocks
+	index.blocksLock.RUnlock()
+	for _, b := range blocks {
+		if positions := b.PositionsFor(word, id); positions != nil {
+			return positions
+		}
 	}
-	index.idMap[localId] = globalId
+	return nil
 }
 
-func (index *PostIndex) AddPost(id uint64, words []string) {
+// AddPost indexes words and returns the ID assigned to the post. IDs are
+// generated here, monotonically increasing, rather than supplied by the
+// caller: that's what lets every posting list go straight from "the ID a
+// query sees" to "the ID the caller gets back" with no idMap indirection
+// in between. If index was opened with OpenIndex, words is written to the
+// WAL first, so a crash between the two can always be recovered by
+// replay -- replaying records in order reproduces the same IDs, since
+// they were assigned by this same counter the first time around.
+func (index *PostIndex) AddPost(words []string) uint64 {
+	if index.wal != nil {
+		if err := index.wal.writeAdd(words); err != nil {
+			panic(err)
+		}
+	}
+	return index.applyAddPost(words)
+}
+
+func (index *PostIndex) applyAddPost(words []string) uint64 {
 	// The order of operations here is pretty critical. We need to ensure is
 	// that each of the sets contains integers in ascending order. IDs must
 	// be added in ascending order or the set operations in the query won't
@@ -140,28 +327,292 @@ func (index *PostIndex) AddPost(id uint64, words []string) {
 	//  - Sort the words, then take the locks for the sets in the order of
 	//    the words. (Sorting the words provides a global lock order,
 	//    ensuring that we won't deadlock.)
-	//  - Generate a new local ID under the locks. Holding the locks before
-	//    we generate the new local ID ensures that no larger ID can be
-	//    inserted into the sets before we're done.
-	//  - Add the mapping from local ID to global ID. Doing this before
-	//    inserting the local ID into the set ensures that any query that
-	//    sees the local ID will be able to reverse it to a local ID.
-	//  - Add the local ID to the relevant sets.
+	//  - Generate a new ID under the locks. Holding the locks before we
+	//    generate the new ID ensures that no larger ID can be inserted
+	//    into the sets before we're done.
+	//  - Add the ID to the relevant sets.
 	//
 	sortedWords := make([]string, len(words), cap(words))
 	copy(sortedWords, words)
 	sort.Strings(sortedWords)
+	sortedWords = dedupeSortedWords(sortedWords)
 
+	// sortedWords must be deduplicated before this point: a repeated word
+	// resolves to the same *PostSet, and locking its SyncRoot twice in the
+	// loop below would deadlock (sync.Mutex isn't reentrant).
 	sets := index.findOrCreateSets(sortedWords)
 	for _, v := range sets {
 		v.SyncRoot.Lock()
 		defer v.SyncRoot.Unlock()
 	}
 
-	localId := (uint32)(atomic.AddInt32(&index.nextLocalId, 1))
-	index.addIdMapping(id, localId)
+	id := uint64(atomic.AddInt64(&index.nextId, 1))
 
 	for _, v := range sets {
-		v.AddPost(localId)
+		v.AddPost(id)
+	}
+
+	// words (not sortedWords) is still in the original, token order the
+	// caller supplied it in, which is what PhraseOperator needs (and,
+	// indirectly, what QueryPostsScored uses for term frequency).
+	index.addPositions(id, words)
+	index.setDocLength(id, len(words))
+
+	return id
+}
+
+// setDocLength records dl as id's document length, growing docLengths as
+// needed. IDs are assigned densely by applyAddPost's atomic counter, so
+// growing to fit whichever id arrives -- regardless of the order AddPost
+// calls actually finish in -- always leaves docLengths dense once every
+// id up to the current nextId has been recorded.
+func (index *PostIndex) setDocLength(id uint64, dl int) {
+	index.docLengthsLock.Lock()
+	defer index.docLengthsLock.Unlock()
+
+	for uint64(len(index.docLengths)) < id {
+		index.docLengths = append(index.docLengths, 0)
+	}
+	index.docLengths[id-1] = uint16(dl)
+
+	atomic.AddInt64(&index.totalDocLen, int64(dl))
+	atomic.AddInt64(&index.docCount, 1)
+}
+
+// docLength returns id's word count, the same way positionsFor falls back
+// to on-disk blocks when id's own AddPost didn't happen (or wasn't
+// replayed) in this process.
+func (index *PostIndex) docLength(id uint64) uint16 {
+	index.docLengthsLock.RLock()
+	var live uint16
+	if id != 0 && uint64(len(index.docLengths)) >= id {
+		live = index.docLengths[id-1]
+	}
+	index.docLengthsLock.RUnlock()
+	if live != 0 {
+		return live
+	}
+
+	index.blocksLock.RLock()
+	blocks := index.blocks
+	index.blocksLock.RUnlock()
+	for _, b := range blocks {
+		if dl, present := b.DocLength(id); present {
+			return dl
+		}
+	}
+	return 0
+}
+
+// avgDocLen returns the mean document length across every post AddPost
+// has seen, the "avgdl" term in the BM25 formula.
+func (index *PostIndex) avgDocLen() float64 {
+	count := atomic.LoadInt64(&index.docCount)
+	if count == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&index.totalDocLen)) / float64(count)
+}
+
+// DeletePost tombstones id so that future queries no longer return it. It
+// does not touch id's PostSet chunk chains directly: AndOperator.nextMatch
+// relies on each chain holding strictly descending IDs, and splicing one
+// out in place would mean rewriting every chunk after it. Compact is the
+// offline path that actually does that rewrite.
+func (index *PostIndex) DeletePost(id uint64) {
+	if index.wal != nil {
+		if err := index.wal.writeDelete(id); err != nil {
+			panic(err)
+		}
+	}
+	index.applyDeletePost(id)
+}
+
+func (index *PostIndex) applyDeletePost(id uint64) {
+	index.tombstoneLock.Lock()
+	defer index.tombstoneLock.Unlock()
+	i := sort.Search(len(index.tombstones), func(i int) bool { return index.tombstones[i] >= id })
+	if i < len(index.tombstones) && index.tombstones[i] == id {
+		return
+	}
+	index.tombstones = append(index.tombstones, 0)
+	copy(index.tombstones[i+1:], index.tombstones[i:])
+	index.tombstones[i] = id
+}
+
+func (index *PostIndex) isTombstoned(id uint64) bool {
+	index.tombstoneLock.RLock()
+	defer index.tombstoneLock.RUnlock()
+	i := sort.Search(len(index.tombstones), func(i int) bool { return index.tombstones[i] >= id })
+	return i < len(index.tombstones) && index.tombstones[i] == id
+}
+
+// Compact walks every PostSet, drops each tombstoned ID from its chunk
+// chain, and clears the tombstone set. This is the offline reclamation
+// path analogous to a Prometheus block rewrite on delete; until it runs,
+// tombstoned IDs stay physically present but filtered out of every query.
+func (index *PostIndex) Compact() {
+	index.setsLock.RLock()
+	sets := make([]*PostSet, 0, len(index.sets))
+	for _, set := range index.sets {
+		sets = append(sets, set)
+	}
+	index.setsLock.RUnlock()
+
+	for _, set := range sets {
+		set.SyncRoot.Lock()
+		set.compact(index)
+		set.SyncRoot.Unlock()
+	}
+
+	index.tombstoneLock.Lock()
+	index.tombstones = nil
+	index.tombstoneLock.Unlock()
+}
+
+// AddBlock registers an already-open on-disk block so that future queries
+// also search it. Blocks are merged with the live, in-memory sets, never
+// replace them, so Snapshot can be called repeatedly without losing
+// history and without making old blocks unreachable.
+func (index *PostIndex) AddBlock(r *block.Reader) {
+	index.blocksLock.Lock()
+	defer index.blocksLock.Unlock()
+	index.blocks = append(index.blocks, r)
+}
+
+// blocksDirName is the conventional subdirectory of a WAL-backed index's
+// root where Snapshot output should be written, one block per
+// subdirectory. OpenIndex scans it to reopen and AddBlock every block a
+// prior process snapshotted, since otherwise the posts captured in a
+// block -- and whose WAL segments Snapshot then truncates -- would be
+// unreachable after a restart.
+const blocksDirName = "blocks"
+
+// Snapshot writes every word currently in the index to an immutable block
+// in dir, in the on-disk format implemented by package block. It does not
+// touch the live, in-memory sets or register the new block with the
+// index; call OpenBlock and AddBlock to start querying it.
+//
+// Snapshot does not remove anything it captures from the live sets
+// either, so until the next restart the same posts stay reachable both
+// through the live chunk chain and through the new block -- OrOperator's
+// merge already de-duplicates equal IDs, so this costs memory, not
+// correct results.
+//
+// Alongside each word's posting list, Snapshot also captures the token
+// positions and doc length of every post that list covers, since a
+// WAL-backed index truncates the records those came from once they're
+// durably captured here: without this, PhraseOperator and
+// QueryPostsScored would silently go blind to a post the moment its WAL
+// segment is gone, even though plain QueryPosts kept returning it fine
+// via the block's postings.
+//
+// For a WAL-backed index (one opened with OpenIndex), pass a directory
+// under blocksDirName (e.g. filepath.Join(indexDir, blocksDirName,
+// name)) so OpenIndex can find this block again after a restart; dir
+// names sort lexically, so pick them so that ordering matches snapshot
+// order (e.g. zero-padded sequence numbers or the WAL segment number).
+func (index *PostIndex) Snapshot(dir string) error {
+	index.setsLock.RLock()
+	words := make(map[string]struct{}, len(index.sets))
+	sets := make(map[string]*PostSet, len(index.sets))
+	for word, set := range index.sets {
+		words[word] = struct{}{}
+		sets[word] = set
+	}
+	index.setsLock.RUnlock()
+
+	w, err := block.NewWriter(dir)
+	if err != nil {
+		return err
+	}
+	if err := w.AddSymbols(words); err != nil {
+		return err
+	}
+
+	docLengths := make(map[uint64]uint16)
+	for word, set := range sets {
+		ids := set.ids()
+		positions := make([][]int32, len(ids))
+		for i, id := range ids {
+			positions[i] = index.positionsFor(word, id)
+			if _, present := docLengths[id]; !present {
+				docLengths[id] = index.docLength(id)
+			}
+		}
+		if err := w.AddPostingList(word, ids, positions); err != nil {
+			return err
+		}
+	}
+	if err := w.AddDocLengths(docLengths); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if index.wal != nil {
+		return index.wal.TruncateBefore(index.wal.CurrentSegment())
+	}
+	return nil
+}
+
+// OpenBlock mmaps a block directory written by a prior call to Snapshot.
+// The caller is responsible for passing the result to AddBlock on every
+// PostIndex that should search it.
+func OpenBlock(dir string) (*block.Reader, error) {
+	return block.OpenBlock(dir)
+}
+
+// findOperatorForQuery builds the QueryOperator ParseQuery installs for a
+// single terminal: the live, in-memory chunk chain for word, unioned with
+// whatever on-disk blocks also have postings for it.
+//
+// The live chain is split into two operands here rather than handed to a
+// single TerminalOperator: the head chunk (still growing, so it's walked
+// the plain way) and, if any chunk behind it has sealed, the set's cached
+// CompressedChunk, which implements LenHint and RandomAccess. On-disk
+// blocks get the same treatment: each block's posting list is decoded in
+// full via Operator.Uids and re-packed into a CompressedChunk.
+//
+// When more than one operand results they are combined with
+// NewUnionOperator, and the OrOperator it builds implements neither
+// LenHint nor RandomAccess. AndOperator's probe path therefore only
+// engages for a word that resolves to a single Decoder, i.e. one with no
+// live set that appears in exactly one block.
+func (index *PostIndex) findOperatorForQuery(word string) QueryOperator {
+	var ops []QueryOperator
+	if set := index.findSetForQuery(word); set != nil {
+		chunk := set.FirstChunk()
+		ops = append(ops, &TerminalOperator{Current: chunk, ChunkCursor: chunk.Length - 1, HeadOnly: true})
+		if sealed := set.SealedCompressed(); sealed != nil {
+			ops = append(ops, sealed.NewDecoder())
+		}
+	}
+
+	index.blocksLock.RLock()
+	blocks := index.blocks
+	index.blocksLock.RUnlock()
+	for _, b := range blocks {
+		if op := b.Query(word); op != nil {
+			ops = append(ops, NewCompressedChunk(op.Uids()).NewDecoder())
+		}
+	}
+
+	return NewUnionOperator(ops...)
+}
+
+// QueryPosts runs query against the index and returns up to limit matching
+// IDs.
+func (index *PostIndex) QueryPosts(query string, limit int) ([]uint64, error) {
+	node, err := ParseQuery(index, query)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]uint64, 0, limit)
+	for len(result) < limit && node.MoveNext() {
+		result = append(result, node.Current())
 	}
+	return result, nil
 }
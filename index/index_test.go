@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strings"
@@ -19,7 +21,6 @@ import (
 )
 
 type testPost struct {
-	id    uint64
 	words []string
 }
 
@@ -54,6 +55,19 @@ func loadAllWords() ([]string, error) {
 	return words, nil
 }
 
+// removeDuplicateWords collapses adjacent duplicate entries in *words,
+// which must already be sorted, in place.
+func removeDuplicateWords(words *[]string) {
+	w := *words
+	out := w[:0]
+	for i, s := range w {
+		if i == 0 || s != w[i-1] {
+			out = append(out, s)
+		}
+	}
+	*words = out
+}
+
 func buildChain() (*Chain, error) {
 	t, err := ioutil.ReadFile("wonderland.txt")
 	if err != nil {
@@ -73,7 +87,7 @@ func createPosts(chain *Chain, count int, rand *rand.Rand) []testPost {
 	posts := make([]testPost, count)
 	for i := 0; i < count; i++ {
 		text := chain.Generate(20, rand)
-		posts[i] = testPost{id: (uint64)(rand.Int63()), words: splitToWords(text)}
+		posts[i] = testPost{words: splitToWords(text)}
 	}
 
 	return posts
@@ -105,8 +119,15 @@ type AlicePost struct {
 }
 
 func (p AlicePost) Generate(rand *rand.Rand, size int) reflect.Value {
-	t := aliceChain.Generate(size, rand)
-	w := splitToWords(t)
+	// randomQuery requires at least one word to terminate recursion, but
+	// Chain.Generate can return "" for a small size or an unlucky prefix;
+	// retry with a larger size until we have something to query.
+	var t string
+	var w []string
+	for attempt := 1; len(w) == 0; attempt++ {
+		t = aliceChain.Generate(size+attempt, rand)
+		w = splitToWords(t)
+	}
 	q := randomQuery(w, rand)
 	return reflect.ValueOf(AlicePost{t, w, q})
 }
@@ -123,10 +144,10 @@ func TestMain(m *testing.M) {
 }
 
 func TestAddAndBasicQuery(t *testing.T) {
-	f := func(post AlicePost, id uint64) bool {
+	f := func(post AlicePost) bool {
 		t.Logf("Testing %s (%v) with query %s", post.Text, post.Words, post.Query)
 		idx := &PostIndex{}
-		idx.AddPost(id, post.Words)
+		id := idx.AddPost(post.Words)
 
 		r, err := idx.QueryPosts(post.Query, 100)
 		return err == nil && len(r) == 1 && r[0] == id
@@ -136,6 +157,379 @@ func TestAddAndBasicQuery(t *testing.T) {
 	}
 }
 
+// TestQueryPostsMatchesRealIDs guards against NextChunk's buffer parameter
+// silently discarding every write: if NextChunk took a plain array
+// argument instead of a pointer, QueryNode.MoveNext would pass it by
+// value, so an implementation writing into it would compile fine but
+// never actually fill the caller's buffer, and every match would come
+// back as the zero ID.
+func TestQueryPostsMatchesRealIDs(t *testing.T) {
+	idx := &PostIndex{}
+	id1 := idx.AddPost([]string{"hello", "world"})
+	id2 := idx.AddPost([]string{"hello", "there"})
+
+	r, err := idx.QueryPosts(`"hello"`, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 2 {
+		t.Fatalf("len(r) = %d, want 2", len(r))
+	}
+	if r[0] != id2 || r[1] != id1 {
+		t.Fatalf("r = %v, want [%d %d]", r, id2, id1)
+	}
+}
+
+// TestOrOperatorDedupesEqualIDs guards against OrOperator's priming check
+// being inverted: if MoveNext isn't called on both sides before the first
+// comparison, NextChunk compares two zero-valued Current()s as if they
+// were a real match, producing a phantom ID-0 result ahead of the real
+// merged stream.
+func TestOrOperatorDedupesEqualIDs(t *testing.T) {
+	chunk := &PostChunk{IDs: [ChunkSize]uint64{0: 1, 1: 2}, Length: 2}
+	left := &TerminalOperator{Current: chunk, ChunkCursor: chunk.Length - 1}
+	right := &TerminalOperator{Current: chunk, ChunkCursor: chunk.Length - 1}
+
+	or := NewOrOperator(left, right)
+	var buffer [queryBufferSize]uint64
+	n := or.NextChunk(&buffer)
+
+	if n != 2 {
+		t.Fatalf("n = %d, want 2 (vals %v)", n, buffer[:n])
+	}
+	if buffer[0] != 2 || buffer[1] != 1 {
+		t.Fatalf("vals = %v, want [2 1]", buffer[:n])
+	}
+}
+
+// TestOpenIndexRediscoversSnapshottedBlocks guards the Snapshot/OpenIndex
+// handoff: Snapshot truncates the WAL segments it captures, so unless
+// OpenIndex also reopens whatever Snapshot wrote, those posts vanish from
+// every query path after a restart.
+func TestOpenIndexRediscoversSnapshottedBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goindex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := idx.AddPost([]string{"hello", "world"})
+
+	if err := idx.Snapshot(filepath.Join(dir, blocksDirName, "00000000")); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := reopened.QueryPosts(`"hello"`, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 || r[0] != id {
+		t.Fatalf("r = %v, want [%d]", r, id)
+	}
+}
+
+// TestAndOperatorUsesSealedCompressedChunks guards the production wiring
+// for CompressedChunk: once a PostSet's head chunk has sealed, queries
+// against it should be backed by a CompressedChunk (ExactLen/Contains),
+// not just a TerminalOperator walking the whole chain, and AndOperator
+// should still return the right answer when one operand is this lopsided.
+func TestAndOperatorUsesSealedCompressedChunks(t *testing.T) {
+	idx := &PostIndex{}
+
+	var wantID uint64
+	for i := int32(0); i < ChunkSize+10; i++ {
+		if i == 3 {
+			wantID = idx.AddPost([]string{"common", "rare"})
+		} else {
+			idx.AddPost([]string{"common"})
+		}
+	}
+
+	if idx.sets["common"].SealedCompressed() == nil {
+		t.Fatal("expected common's PostSet to have sealed a CompressedChunk after more than ChunkSize posts")
+	}
+
+	r, err := idx.QueryPosts(`"common""rare"&`, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 || r[0] != wantID {
+		t.Fatalf("r = %v, want [%d]", r, wantID)
+	}
+}
+
+// TestDeletePostAndCompact guards DeletePost's tombstone filtering and
+// Compact's chunk-chain rewrite: a deleted post must disappear from query
+// results immediately (via the tombstone filter), and after Compact it must
+// still be gone even though the tombstone set backing that filter has been
+// cleared.
+func TestDeletePostAndCompact(t *testing.T) {
+	idx := &PostIndex{}
+	id1 := idx.AddPost([]string{"hello", "world"})
+	id2 := idx.AddPost([]string{"hello", "there"})
+
+	idx.DeletePost(id1)
+
+	r, err := idx.QueryPosts(`"hello"`, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 || r[0] != id2 {
+		t.Fatalf("r = %v, want [%d]", r, id2)
+	}
+
+	idx.Compact()
+
+	if len(idx.tombstones) != 0 {
+		t.Fatalf("tombstones = %v, want empty after Compact", idx.tombstones)
+	}
+
+	r, err = idx.QueryPosts(`"hello"`, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 || r[0] != id2 {
+		t.Fatalf("after Compact: r = %v, want [%d]", r, id2)
+	}
+
+	set := idx.sets["hello"]
+	if set.DocFreq() != 1 {
+		t.Fatalf("DocFreq() = %d, want 1 after Compact", set.DocFreq())
+	}
+}
+
+// TestOpenIndexReplaysWAL guards OpenIndex's replay path: AddPost/DeletePost
+// calls against a WAL-backed index must survive a restart (a fresh
+// OpenIndex against the same directory, standing in for a process crash and
+// restart) with the same query results as before.
+func TestOpenIndexReplaysWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-replay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1 := idx.AddPost([]string{"hello", "world"})
+	_ = idx.AddPost([]string{"goodbye", "world"})
+	idx.DeletePost(id1)
+	if err := idx.wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.wal.Close()
+
+	r, err := restarted.QueryPosts(`"world"`, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 {
+		t.Fatalf("r = %v, want exactly one surviving post for %q", r, "world")
+	}
+	if r[0] == id1 {
+		t.Fatalf("r = %v, want the deleted post %d filtered out", r, id1)
+	}
+}
+
+// TestOpenIndexRestoresNextIdPastTruncatedSegments guards the ID
+// high-water mark across a snapshot: once TruncateBefore has removed the
+// WAL segment that recorded a post's add, OpenIndex must still learn that
+// post's ID from the block it now lives in and restore nextId past it --
+// otherwise a restart reissues an ID that's still live on disk.
+func TestOpenIndexRestoresNextIdPastTruncatedSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-truncate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1 := idx.AddPost([]string{"hello", "world"})
+	id2 := idx.AddPost([]string{"hello", "there"})
+
+	// Roll the WAL onto a fresh segment, as if it had grown past
+	// walSegmentSize on its own, so the segment holding id1/id2 is
+	// "older than current" by the time Snapshot truncates.
+	if err := idx.wal.rollSegment(); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Snapshot(filepath.Join(dir, blocksDirName, "00000000")); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.wal.Close()
+
+	id3 := restarted.AddPost([]string{"goodbye"})
+	if id3 == id1 || id3 == id2 {
+		t.Fatalf("id3 = %d, collides with a post (%d, %d) already captured in the block", id3, id1, id2)
+	}
+	if id3 <= id2 {
+		t.Fatalf("id3 = %d, want something greater than %d", id3, id2)
+	}
+}
+
+// TestSnapshotPreservesPositionsAndDocLengthAcrossRestart guards the data
+// a WAL-backed index's Snapshot+restart cycle used to silently lose:
+// PhraseOperator adjacency and QueryPostsScored's BM25 term frequency both
+// depend on per-(word,id) token positions and per-id doc length, neither
+// of which plain postings carry. Once a post's WAL record is truncated
+// after Snapshot, those need to come from the block instead, or phrase
+// queries and scoring go quietly wrong for that post with no error.
+func TestSnapshotPreservesPositionsAndDocLengthAcrossRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-snapshot-positions-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := idx.AddPost([]string{"the", "white", "rabbit", "ran"})
+
+	if err := idx.wal.rollSegment(); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Snapshot(filepath.Join(dir, blocksDirName, "00000000")); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.wal.Close()
+
+	r, err := restarted.QueryPosts(`"the white rabbit"`, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 || r[0] != id {
+		t.Fatalf("phrase query after restart: r = %v, want [%d]", r, id)
+	}
+
+	scored, err := restarted.QueryPostsScored(`"rabbit"`, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scored) != 1 || scored[0].ID != id {
+		t.Fatalf("scored query after restart: r = %v, want one result for %d", scored, id)
+	}
+	if scored[0].Score <= 0 {
+		t.Fatalf("scored[0].Score = %v, want a positive BM25 score", scored[0].Score)
+	}
+}
+
+// TestNotOperatorExcludesMatches guards the unary "!" query operator: it
+// should yield every post except the ones its operand matches.
+func TestNotOperatorExcludesMatches(t *testing.T) {
+	idx := &PostIndex{}
+	idx.AddPost([]string{"hello", "world"})
+	id2 := idx.AddPost([]string{"goodbye", "world"})
+
+	r, err := idx.QueryPosts(`"hello"!`, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 || r[0] != id2 {
+		t.Fatalf("r = %v, want [%d]", r, id2)
+	}
+}
+
+// TestPhraseOperatorRequiresAdjacency guards PhraseOperator: a quoted,
+// multi-word string constant should only match posts where those words
+// appear adjacent and in order, not just posts that happen to contain the
+// same vocabulary in some other arrangement.
+func TestPhraseOperatorRequiresAdjacency(t *testing.T) {
+	idx := &PostIndex{}
+	adjacent := idx.AddPost([]string{"the", "white", "rabbit", "ran"})
+	idx.AddPost([]string{"the", "rabbit", "was", "white"})
+
+	r, err := idx.QueryPosts(`"the white rabbit"`, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 || r[0] != adjacent {
+		t.Fatalf("r = %v, want [%d]", r, adjacent)
+	}
+}
+
+// TestPostIDsSurviveBeyondUint32Range guards the widened post ID: PostChunk
+// stores IDs as uint64 now (no idMap narrowing them down), so an ID beyond
+// math.MaxUint32 must still round-trip through a query untruncated. This
+// builds the PostSet directly rather than going through PostIndex.AddPost,
+// which would otherwise grow the id-indexed docLengths slice out to the ID
+// itself.
+func TestPostIDsSurviveBeyondUint32Range(t *testing.T) {
+	id := uint64(math.MaxUint32) + 1
+
+	set := NewPostSet()
+	set.AddPost(id)
+
+	idx := &PostIndex{sets: map[string]*PostSet{"hello": set}}
+
+	r, err := idx.QueryPosts(`"hello"`, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 || r[0] != id {
+		t.Fatalf("r = %v, want [%d]", r, id)
+	}
+}
+
+// TestQueryPostsScoredRanksByBM25 guards QueryPostsScored: among posts that
+// all match the query, the one where the term is more frequent relative to
+// its length should score higher and come back first.
+func TestQueryPostsScoredRanksByBM25(t *testing.T) {
+	idx := &PostIndex{}
+	low := idx.AddPost([]string{"rabbit", "ran", "down", "the", "hole"})
+	high := idx.AddPost([]string{"rabbit", "rabbit", "rabbit"})
+
+	r, err := idx.QueryPostsScored(`"rabbit"`, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 2 {
+		t.Fatalf("r = %v, want 2 results", r)
+	}
+	if r[0].ID != high || r[1].ID != low {
+		t.Fatalf("r = %v, want %d ranked above %d", r, high, low)
+	}
+	if r[0].Score <= r[1].Score {
+		t.Fatalf("r[0].Score = %v, want it strictly greater than r[1].Score = %v", r[0].Score, r[1].Score)
+	}
+}
+
 func BenchmarkAddPost(b *testing.B) {
 	rand := rand.New(rand.NewSource(time.Now().UnixNano()))
 	idx := &PostIndex{}
@@ -148,7 +542,7 @@ func BenchmarkAddPost(b *testing.B) {
 		for pb.Next() {
 			i := atomic.AddInt32(&index, 1)
 			p := posts[i]
-			idx.AddPost(p.id, p.words)
+			idx.AddPost(p.words)
 		}
 	})
 }
@@ -159,7 +553,7 @@ func BenchmarkQueryPost(b *testing.B) {
 	idx := &PostIndex{}
 	posts := createPosts(aliceChain, 100000, rand) // Large number of posts to query
 	for _, v := range posts {
-		idx.AddPost(v.id, v.words)
+		idx.AddPost(v.words)
 	}
 
 	queries := make([]string, b.N)
@@ -187,7 +581,7 @@ func BenchmarkAddAndQueryPost(b *testing.B) {
 	idx := &PostIndex{}
 	posts := createPosts(aliceChain, 100000, rand) // Large number of posts to query
 	for _, v := range posts {
-		idx.AddPost(v.id, v.words)
+		idx.AddPost(v.words)
 	}
 
 	posts = createPosts(aliceChain, b.N, rand) // New posts!
@@ -206,7 +600,7 @@ func BenchmarkAddAndQueryPost(b *testing.B) {
 			i := atomic.AddInt32(&index, 1)
 			if rand.Intn(5) == 0 {
 				p := posts[i]
-				idx.AddPost(p.id, p.words)
+				idx.AddPost(p.words)
 			} else {
 				q := queries[i]
 				idx.QueryPosts(q, 100)
@@ -1,21 +1,27 @@
 package index
 
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
 const beforeStartedLength int = 0
 const doneLength = -1
 const queryBufferSize int = 128
 
 type QueryOperator interface {
-	NextChunk(buffer [queryBufferSize]uint32) int
+	NextChunk(buffer *[queryBufferSize]uint64) int
 }
 
 type QueryNode struct {
-	buffer [queryBufferSize]uint32
+	buffer [queryBufferSize]uint64
 	length int
 	cursor int
 	op     QueryOperator
 }
 
-func (q *QueryNode) Current() uint32 {
+func (q *QueryNode) Current() uint64 {
 	return q.buffer[q.cursor]
 }
 
@@ -31,7 +37,7 @@ func (q *QueryNode) MoveNext() bool {
 	if !q.Done() {
 		q.cursor++
 		if q.cursor >= q.length {
-			q.length = q.op.NextChunk(q.buffer)
+			q.length = q.op.NextChunk(&q.buffer)
 			if q.length == 0 { // NextChunk returns 0 to signal completion.
 				q.length = doneLength
 			}
@@ -45,13 +51,27 @@ func (q *QueryNode) MoveNext() bool {
 type TerminalOperator struct {
 	Current     *PostChunk
 	ChunkCursor int32
+
+	// HeadOnly stops NextChunk at the end of Current's own IDs instead of
+	// following Current.Next into the rest of the chunk chain. Set this
+	// when Current is a PostSet's live head chunk and the sealed chain
+	// behind it is already covered by a CompressedChunk decoder, so that
+	// range isn't walked (and double-counted) here too.
+	HeadOnly bool
 }
 
-func (op *TerminalOperator) NextChunk(buffer [queryBufferSize]uint32) int {
+func (op *TerminalOperator) NextChunk(buffer *[queryBufferSize]uint64) int {
 	var i int = 0
 	for i < queryBufferSize && op.Current != nil {
 		if op.ChunkCursor < 0 {
+			if op.HeadOnly {
+				op.Current = nil
+				break
+			}
 			op.Current = op.Current.Next
+			if op.Current == nil {
+				break
+			}
 			op.ChunkCursor = op.Current.Length - 1
 		}
 		buffer[i] = op.Current.IDs[op.ChunkCursor]
@@ -61,6 +81,31 @@ func (op *TerminalOperator) NextChunk(buffer [queryBufferSize]uint32) int {
 	return i
 }
 
+// andJumpStride and andRatioThreshold tune AndOperator's intersection
+// strategy: below the ratio threshold it walks both sides with a fixed
+// stride-32 lookahead into the buffer it already has in hand (comparing
+// the far end of the jump against the other side's current value before
+// committing to it); at or above the threshold, with both sides able to
+// report their length and probe for a specific ID cheaply, it iterates
+// the shorter side and binary-searches each element into the longer one.
+// This mirrors the technique dgraph uses for posting list intersection.
+const andJumpStride = 32
+const andRatioThreshold = 10
+
+// LenHint is implemented by QueryOperators that can report their exact
+// length without a linear scan, such as Decoder over a CompressedChunk.
+// The length is that of the whole list, regardless of how much of it has
+// already been consumed.
+type LenHint interface {
+	ExactLen() int
+}
+
+// RandomAccess is implemented by QueryOperators that can answer whether a
+// specific ID is present without scanning every element before it.
+type RandomAccess interface {
+	Contains(id uint64) bool
+}
+
 type AndOperator struct {
 	Left  QueryNode
 	Right QueryNode
@@ -70,29 +115,93 @@ func NewAndOperator(left QueryOperator, right QueryOperator) *AndOperator {
 	return &AndOperator{QueryNode{op: left}, QueryNode{op: right}}
 }
 
-func (op *AndOperator) nextMatch() (uint32, bool) {
+func (op *AndOperator) nextMatch() (uint64, bool) {
+	if small, large, ok := op.probeOperands(); ok {
+		return op.nextMatchByProbe(small, large)
+	}
+	return op.nextMatchLinear()
+}
+
+// probeOperands returns (shorter side, longer side, true) when both
+// operands implement LenHint and RandomAccess and are lopsided enough
+// that probing the longer side beats merging it element by element.
+func (op *AndOperator) probeOperands() (*QueryNode, *QueryNode, bool) {
+	leftHint, ok := op.Left.op.(LenHint)
+	if !ok {
+		return nil, nil, false
+	}
+	rightHint, ok := op.Right.op.(LenHint)
+	if !ok {
+		return nil, nil, false
+	}
+	if _, ok := op.Left.op.(RandomAccess); !ok {
+		return nil, nil, false
+	}
+	if _, ok := op.Right.op.(RandomAccess); !ok {
+		return nil, nil, false
+	}
+
+	leftLen, rightLen := leftHint.ExactLen(), rightHint.ExactLen()
+	if leftLen == 0 || rightLen == 0 {
+		return nil, nil, false
+	}
+
+	if rightLen/leftLen >= andRatioThreshold {
+		return &op.Left, &op.Right, true
+	}
+	if leftLen/rightLen >= andRatioThreshold {
+		return &op.Right, &op.Left, true
+	}
+	return nil, nil, false
+}
+
+func (op *AndOperator) nextMatchByProbe(small, large *QueryNode) (uint64, bool) {
+	probe := large.op.(RandomAccess)
+	for small.MoveNext() {
+		if probe.Contains(small.Current()) {
+			return small.Current(), true
+		}
+	}
+	return 0, false
+}
+
+func (op *AndOperator) nextMatchLinear() (uint64, bool) {
 	if !(op.Left.MoveNext() && op.Right.MoveNext()) {
 		return 0, false
 	}
 
 	for op.Left.Current() != op.Right.Current() {
-		for op.Left.Current() > op.Right.Current() {
-			if !op.Left.MoveNext() {
-				return 0, false
-			}
+		if !advancePast(&op.Left, op.Right.Current()) {
+			return 0, false
 		}
-
-		for op.Right.Current() > op.Left.Current() {
-			if !op.Right.MoveNext() {
-				return 0, false
-			}
+		if !advancePast(&op.Right, op.Left.Current()) {
+			return 0, false
 		}
 	}
 
 	return op.Left.Current(), true
 }
 
-func (op *AndOperator) NextChunk(buffer [queryBufferSize]uint32) int {
+// advancePast moves node forward -- toward smaller IDs, since everything
+// here is descending -- until its current value is no longer greater than
+// target. Before taking single steps it peeks andJumpStride elements
+// ahead in the buffer node already holds; if that element hasn't passed
+// target yet, it's safe to skip straight to it instead of visiting every
+// element in between.
+func advancePast(node *QueryNode, target uint64) bool {
+	for node.Current() > target {
+		if node.cursor+andJumpStride < node.length && node.buffer[node.cursor+andJumpStride] >= target {
+			node.cursor += andJumpStride
+			continue
+		}
+		if !node.MoveNext() {
+			return false
+		}
+	}
+	return true
+}
+
+func (op *AndOperator) NextChunk(buffer *[queryBufferSize]uint64) int {
 	i := 0
 	for i < queryBufferSize {
 		if value, success := op.nextMatch(); success {
@@ -114,8 +223,8 @@ func NewOrOperator(left QueryOperator, right QueryOperator) *OrOperator {
 	return &OrOperator{QueryNode{op: left}, QueryNode{op: right}}
 }
 
-func (op *OrOperator) NextChunk(buffer [queryBufferSize]uint32) int {
-	if !op.Left.Started() {
+func (op *OrOperator) NextChunk(buffer *[queryBufferSize]uint64) int {
+	if op.Left.Started() {
 		op.Left.MoveNext()
 		op.Right.MoveNext()
 	}
@@ -150,6 +259,160 @@ func (op *OrOperator) NextChunk(buffer [queryBufferSize]uint32) int {
 	return i
 }
 
+type emptyOperator struct{}
+
+func (emptyOperator) NextChunk(buffer *[queryBufferSize]uint64) int { return 0 }
+
+// NewUnionOperator returns the union of ops, each of which is expected to
+// produce IDs in descending order. It folds them pairwise through
+// OrOperator, the same way ParseQuery folds the binary & and | operators,
+// so that a term present in the live index and in N on-disk blocks reads
+// as a single merged stream.
+func NewUnionOperator(ops ...QueryOperator) QueryOperator {
+	switch len(ops) {
+	case 0:
+		return emptyOperator{}
+	case 1:
+		return ops[0]
+	default:
+		result := ops[0]
+		for _, op := range ops[1:] {
+			result = NewOrOperator(result, op)
+		}
+		return result
+	}
+}
+
+// TombstoneFilterOperator wraps another QueryOperator and drops any ID
+// that PostIndex.DeletePost has tombstoned. ParseQuery installs exactly
+// one of these at the root of every query tree, so a deleted post can
+// never surface as a match even though it's still physically present in
+// its PostSet chunk chain until the next Compact.
+type TombstoneFilterOperator struct {
+	Inner QueryNode
+	index *PostIndex
+}
+
+func NewTombstoneFilterOperator(index *PostIndex, inner QueryOperator) *TombstoneFilterOperator {
+	return &TombstoneFilterOperator{QueryNode{op: inner}, index}
+}
+
+func (op *TombstoneFilterOperator) NextChunk(buffer *[queryBufferSize]uint64) int {
+	i := 0
+	for i < queryBufferSize && op.Inner.MoveNext() {
+		if !op.index.isTombstoned(op.Inner.Current()) {
+			buffer[i] = op.Inner.Current()
+			i++
+		}
+	}
+	return i
+}
+
+// NotOperator yields the complement of Child relative to the currently
+// live ID space: every ID the index has assigned, descending from the
+// newest, that Child's stream doesn't produce and that isn't tombstoned.
+// ParseQuery builds one for a postfix unary '!' following its operand.
+type NotOperator struct {
+	Child QueryNode
+	index *PostIndex
+
+	started bool
+	cursor  uint64 // next candidate ID to consider, counting down to 1
+}
+
+func NewNotOperator(index *PostIndex, child QueryOperator) *NotOperator {
+	return &NotOperator{Child: QueryNode{op: child}, index: index}
+}
+
+func (op *NotOperator) NextChunk(buffer *[queryBufferSize]uint64) int {
+	if !op.started {
+		op.started = true
+		op.cursor = uint64(atomic.LoadInt64(&op.index.nextId))
+		op.Child.MoveNext()
+	}
+
+	i := 0
+	for i < queryBufferSize && op.cursor > 0 {
+		id := op.cursor
+		op.cursor--
+
+		for !op.Child.Done() && op.Child.Current() > id {
+			op.Child.MoveNext()
+		}
+		if !op.Child.Done() && op.Child.Current() == id {
+			continue
+		}
+		if op.index.isTombstoned(id) {
+			continue
+		}
+
+		buffer[i] = id
+		i++
+	}
+	return i
+}
+
+// PhraseOperator matches only posts where its words appear adjacent, in
+// order. It intersects the constituent word posting lists the same way
+// AndOperator does, then, for each surviving ID, checks the per-word
+// token positions PostIndex.addPositions recorded to confirm the words
+// actually run consecutively rather than just all being present.
+type PhraseOperator struct {
+	words []string
+	ids   QueryNode
+	index *PostIndex
+}
+
+// NewPhraseOperator builds a PhraseOperator for words, which must have at
+// least one element; ParseQuery never calls it with fewer.
+func NewPhraseOperator(index *PostIndex, words []string) *PhraseOperator {
+	merged := index.findOperatorForQuery(words[0])
+	for _, word := range words[1:] {
+		merged = NewAndOperator(merged, index.findOperatorForQuery(word))
+	}
+	return &PhraseOperator{words: words, ids: QueryNode{op: merged}, index: index}
+}
+
+func (op *PhraseOperator) NextChunk(buffer *[queryBufferSize]uint64) int {
+	i := 0
+	for i < queryBufferSize && op.ids.MoveNext() {
+		id := op.ids.Current()
+		if op.matches(id) {
+			buffer[i] = id
+			i++
+		}
+	}
+	return i
+}
+
+func (op *PhraseOperator) matches(id uint64) bool {
+	for _, start := range op.index.positionsFor(op.words[0], id) {
+		if op.alignsFrom(id, start) {
+			return true
+		}
+	}
+	return false
+}
+
+// alignsFrom reports whether, starting at token offset start, each of
+// op.words[1:] appears at the next consecutive offset in id's post.
+func (op *PhraseOperator) alignsFrom(id uint64, start int32) bool {
+	for i := 1; i < len(op.words); i++ {
+		want := start + int32(i)
+		found := false
+		for _, p := range op.index.positionsFor(op.words[i], id) {
+			if p == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 type ParseError struct {
 	Position int
 	Message  string
@@ -180,14 +443,19 @@ func ParseQuery(index *PostIndex, query string) (*QueryNode, error) {
 	for i := 0; i < len(query); i++ {
 		if query[i] == '&' {
 			if stack.Length() < 2 {
-				return nil, ParseError{i, "Need two operands for &"}
+				return nil, ParseError{i, fmt.Sprintf("Need two operands for %q", query[i])}
 			}
 			stack.Push(NewAndOperator(stack.Pop(), stack.Pop()))
 		} else if query[i] == '|' {
 			if stack.Length() < 2 {
-				return nil, ParseError{i, "Need two operands for |"}
+				return nil, ParseError{i, fmt.Sprintf("Need two operands for %q", query[i])}
 			}
 			stack.Push(NewOrOperator(stack.Pop(), stack.Pop()))
+		} else if query[i] == '!' {
+			if stack.Length() < 1 {
+				return nil, ParseError{i, fmt.Sprintf("Need one operand for %q", query[i])}
+			}
+			stack.Push(NewNotOperator(index, stack.Pop()))
 		} else if query[i] == '"' {
 			i++
 			start := i
@@ -196,17 +464,23 @@ func ParseQuery(index *PostIndex, query string) (*QueryNode, error) {
 				i++
 			}
 			if i >= len(query) {
-				return nil, ParseError{start - 1, "Unterminated string constant"}
+				return nil, ParseError{start - 1, fmt.Sprintf("Unterminated string constant starting at %q", query[start-1:])}
 			}
 
-			chunk := index.findSetChunkForQuery(query[start:i])
-			stack.Push(&TerminalOperator{Current: chunk})
+			words := strings.Fields(query[start:i])
+			if len(words) == 0 {
+				return nil, ParseError{start, "Empty string constant"}
+			} else if len(words) == 1 {
+				stack.Push(index.findOperatorForQuery(words[0]))
+			} else {
+				stack.Push(NewPhraseOperator(index, words))
+			}
 		} else {
-			return nil, ParseError{i, "Unexpected character"}
+			return nil, ParseError{i, fmt.Sprintf("Unexpected character %q", query[i])}
 		}
 	}
 	if stack.Length() != 1 {
 		return nil, ParseError{len(query), "Unterminated query"}
 	}
-	return &QueryNode{op: stack.Pop()}, nil
+	return &QueryNode{op: NewTombstoneFilterOperator(index, stack.Pop())}, nil
 }
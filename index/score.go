@@ -0,0 +1,189 @@
+package index
+
+import (
+	"container/heap"
+	"math"
+	"strings"
+	"sync/atomic"
+)
+
+// bm25K1 and bm25B are the usual Okapi BM25 defaults: k1 controls term
+// frequency saturation, b controls how strongly document length is
+// normalized against the average.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// ScoredResult is one match from QueryPostsScored, along with its BM25
+// relevance score.
+type ScoredResult struct {
+	ID    uint64
+	Score float64
+}
+
+// QueryPostsScored is QueryPosts ranked by BM25 relevance instead of
+// returned in match order: it returns up to k results, highest score
+// first.
+func (index *PostIndex) QueryPostsScored(query string, k int) ([]ScoredResult, error) {
+	return index.QueryPostsScoredAfter(query, k, math.Inf(1))
+}
+
+// QueryPostsScoredAfter is QueryPostsScored with a pagination cutoff:
+// only matches scoring strictly below after are considered, so a caller
+// can fetch the next page by passing the lowest score from the previous
+// one.
+func (index *PostIndex) QueryPostsScoredAfter(query string, k int, after float64) ([]ScoredResult, error) {
+	node, err := ParseQuery(index, query)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := queryTerms(query)
+	idf := make(map[string]float64, len(terms))
+	for _, term := range terms {
+		if _, present := idf[term]; !present {
+			idf[term] = index.idf(term)
+		}
+	}
+
+	avgdl := index.avgDocLen()
+	if avgdl == 0 {
+		avgdl = 1
+	}
+
+	top := newTopKHeap(k)
+	for node.MoveNext() {
+		id := node.Current()
+		top.push(ScoredResult{ID: id, Score: index.bm25Score(id, terms, idf, avgdl)}, after)
+	}
+	return top.sorted(), nil
+}
+
+// queryTerms pulls every word out of query's quoted terminals, in the
+// same order ParseQuery's quote-handling walks them. Scoring only cares
+// about which words are present, not the &/|/! structure around them, so
+// it doesn't need a full parse tree -- just the vocabulary ParseQuery
+// would otherwise have built one for.
+func queryTerms(query string) []string {
+	var terms []string
+	for i := 0; i < len(query); i++ {
+		if query[i] != '"' {
+			continue
+		}
+		i++
+		start := i
+		for i < len(query) && query[i] != '"' {
+			i++
+		}
+		terms = append(terms, strings.Fields(query[start:i])...)
+	}
+	return terms
+}
+
+// idf is the Lucene-style smoothed inverse document frequency for word:
+// ln(1 + (N-df+0.5)/(df+0.5)). It stays positive even when a term
+// appears in more than half the index, unlike the classic Robertson-Spärck
+// Jones form.
+//
+// Both N and df are summed across the live sets and every on-disk block,
+// the same way docLength and positionsFor fall back to blocks: once a
+// WAL-backed index has truncated the records for a snapshotted post,
+// index.sets no longer knows that post (or its word) exists at all, and
+// idf would otherwise silently treat it as absent from the corpus. This
+// can double-count a post that's still reachable through both the live
+// set and a block (Snapshot doesn't remove what it captures), the same
+// trade Snapshot's own doc comment already makes for query results.
+func (index *PostIndex) idf(word string) float64 {
+	index.setsLock.RLock()
+	set, present := index.sets[word]
+	index.setsLock.RUnlock()
+
+	var df float64
+	if present {
+		df = float64(set.DocFreq())
+	}
+	n := float64(atomic.LoadInt64(&index.docCount))
+
+	index.blocksLock.RLock()
+	blocks := index.blocks
+	index.blocksLock.RUnlock()
+	for _, b := range blocks {
+		n += float64(b.DocCount())
+		if count, ok := b.PostingCount(word); ok {
+			df += float64(count)
+		}
+	}
+
+	if df == 0 {
+		return 0
+	}
+	return math.Log(1 + (n-df+0.5)/(df+0.5))
+}
+
+// bm25Score sums the BM25 contribution of every term in terms for id.
+func (index *PostIndex) bm25Score(id uint64, terms []string, idf map[string]float64, avgdl float64) float64 {
+	dl := float64(index.docLength(id))
+
+	var score float64
+	for _, term := range terms {
+		tf := float64(len(index.positionsFor(term, id)))
+		if tf == 0 {
+			continue
+		}
+		denom := tf + bm25K1*(1-bm25B+bm25B*dl/avgdl)
+		score += idf[term] * (tf * (bm25K1 + 1)) / denom
+	}
+	return score
+}
+
+// scoreHeap is a min-heap of ScoredResult ordered by Score, the backing
+// store for topKHeap.
+type scoreHeap []ScoredResult
+
+func (h scoreHeap) Len() int            { return len(h) }
+func (h scoreHeap) Less(i, j int) bool  { return h[i].Score < h[j].Score }
+func (h scoreHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *scoreHeap) Push(x interface{}) { *h = append(*h, x.(ScoredResult)) }
+func (h *scoreHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// topKHeap keeps the k highest-scoring results seen so far without
+// materializing the full match set: once it holds k results, a new one
+// only survives by displacing the current lowest score.
+type topKHeap struct {
+	h scoreHeap
+	k int
+}
+
+func newTopKHeap(k int) *topKHeap {
+	return &topKHeap{k: k}
+}
+
+func (t *topKHeap) push(r ScoredResult, after float64) {
+	if t.k <= 0 || r.Score >= after {
+		return
+	}
+	if t.h.Len() < t.k {
+		heap.Push(&t.h, r)
+		return
+	}
+	if r.Score > t.h[0].Score {
+		heap.Pop(&t.h)
+		heap.Push(&t.h, r)
+	}
+}
+
+// sorted drains the heap into a slice ordered highest score first.
+func (t *topKHeap) sorted() []ScoredResult {
+	result := make([]ScoredResult, t.h.Len())
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(&t.h).(ScoredResult)
+	}
+	return result
+}
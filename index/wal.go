@@ -0,0 +1,382 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	walSegmentSize = 128 << 20 // 128 MiB; rolled so old segments can be truncated once a Snapshot covers them
+	walFileSuffix  = ".wal"
+
+	walRecordAdd    byte = 1
+	walRecordDelete byte = 2
+)
+
+// WAL is a crash-safe, append-only log of AddPost/DeletePost calls.
+// PostIndex writes a record here before applying the corresponding
+// mutation to its in-memory sets, so that OpenIndex can replay the log to
+// rebuild nextId and sets after a restart. Add records don't carry an
+// explicit ID: replaying them in order reassigns the same IDs the first
+// pass did, since both use the same monotonic counter.
+//
+// Each record is length-prefixed and CRC32-checksummed:
+//
+//	uvarint(len(payload)) | payload | crc32(payload) as 4 bytes, big-endian
+//	payload := recordType byte | body
+//
+// The log is segmented into fixed-size files so that old segments can be
+// removed once a Snapshot has durably captured everything they contain.
+type WAL struct {
+	dir string
+
+	// NoSync disables fsync after every record, for benchmarks (like
+	// BenchmarkAddPost) that want to measure only the indexing path. Sync
+	// can still be called to force a flush when NoSync is set.
+	NoSync bool
+
+	mu       sync.Mutex
+	file     *os.File
+	buf      *bufio.Writer
+	segment  int
+	segBytes int64
+}
+
+// NewWAL creates (or reopens) a WAL rooted at dir, appending to the newest
+// existing segment if any, or starting segment 0 otherwise.
+func NewWAL(dir string) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	segments, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{dir: dir}
+	last := 0
+	if len(segments) > 0 {
+		last = segments[len(segments)-1]
+	}
+	if err := w.openSegment(last); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func walSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []int
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != walFileSuffix {
+			continue
+		}
+		var segment int
+		if _, err := fmt.Sscanf(e.Name(), "%08d"+walFileSuffix, &segment); err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func (w *WAL) segmentPath(segment int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%08d%s", segment, walFileSuffix))
+}
+
+func (w *WAL) openSegment(segment int) error {
+	f, err := os.OpenFile(w.segmentPath(segment), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.buf = bufio.NewWriter(f)
+	w.segment = segment
+	w.segBytes = info.Size()
+	return nil
+}
+
+func (w *WAL) rollSegment() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return w.openSegment(w.segment + 1)
+}
+
+// Sync flushes buffered records and fsyncs the current segment. It's only
+// necessary when NoSync is set; otherwise every record already does this
+// before writeRecord returns.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.syncLocked()
+}
+
+func (w *WAL) syncLocked() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// writeRecord appends one record under w.mu: concurrent AddPost/DeletePost
+// calls queue here the same way findOrCreateSets queues on setsLock, so
+// the log never interleaves a partial record from one caller with
+// another's. Records are not batched: unless NoSync is set, each one is
+// flushed and fsynced on its own before writeRecord returns.
+func (w *WAL) writeRecord(recordType byte, body []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	payload := make([]byte, 0, 1+len(body))
+	payload = append(payload, recordType)
+	payload = append(payload, body...)
+
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], uint64(len(payload)))
+
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(payload))
+
+	written := 0
+	for _, b := range [][]byte{scratch[:n], payload, crc[:]} {
+		m, err := w.buf.Write(b)
+		written += m
+		if err != nil {
+			return err
+		}
+	}
+	w.segBytes += int64(written)
+
+	if !w.NoSync {
+		if err := w.syncLocked(); err != nil {
+			return err
+		}
+	}
+
+	if w.segBytes >= walSegmentSize {
+		return w.rollSegment()
+	}
+	return nil
+}
+
+func (w *WAL) writeAdd(words []string) error {
+	var body []byte
+	var scratch [binary.MaxVarintLen64]byte
+
+	n := binary.PutUvarint(scratch[:], uint64(len(words)))
+	body = append(body, scratch[:n]...)
+
+	for _, word := range words {
+		n = binary.PutUvarint(scratch[:], uint64(len(word)))
+		body = append(body, scratch[:n]...)
+		body = append(body, word...)
+	}
+
+	return w.writeRecord(walRecordAdd, body)
+}
+
+func (w *WAL) writeDelete(id uint64) error {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], id)
+	return w.writeRecord(walRecordDelete, scratch[:n])
+}
+
+// CurrentSegment returns the segment number currently being appended to,
+// for use with TruncateBefore after a Snapshot.
+func (w *WAL) CurrentSegment() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.segment
+}
+
+// TruncateBefore removes every WAL segment older than segment. Callers are
+// expected to only do this after a Snapshot has durably captured
+// everything those segments recorded.
+func (w *WAL) TruncateBefore(segment int) error {
+	segments, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s >= segment {
+			continue
+		}
+		if err := os.Remove(w.segmentPath(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// OpenIndex opens (creating if necessary) a WAL-backed PostIndex rooted at
+// dir, replaying every record to rebuild nextId and sets before
+// returning. Subsequent calls to AddPost/DeletePost on the returned index
+// write through to the same WAL.
+func OpenIndex(dir string) (*PostIndex, error) {
+	walDir := filepath.Join(dir, "wal")
+	index := &PostIndex{}
+
+	segments, err := walSegmentsOrEmpty(walDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		if err := replaySegment(index, walDir, segment); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := openSnapshottedBlocks(index, filepath.Join(dir, blocksDirName)); err != nil {
+		return nil, err
+	}
+
+	wal, err := NewWAL(walDir)
+	if err != nil {
+		return nil, err
+	}
+	index.wal = wal
+	return index, nil
+}
+
+func walSegmentsOrEmpty(dir string) ([]int, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return walSegments(dir)
+}
+
+// openSnapshottedBlocks reopens every block directory under blocksDir, in
+// name order, and registers each with index via AddBlock. It's the other
+// half of Snapshot's documented blocksDirName convention: without it, the
+// posts a prior process snapshotted -- and whose WAL segments Snapshot
+// truncated -- would simply be gone after a restart.
+//
+// It also raises index.nextId to cover every block's Reader.MaxID(),
+// since replay alone only counts however many add records are left in the
+// WAL after TruncateBefore -- it has no idea about posts whose only
+// remaining record of existing is the block itself. Without this, a
+// restart after a snapshot can hand out an ID that collides with one
+// that's still live in one of these blocks.
+func openSnapshottedBlocks(index *PostIndex, blocksDir string) error {
+	entries, err := os.ReadDir(blocksDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		r, err := OpenBlock(filepath.Join(blocksDir, name))
+		if err != nil {
+			return err
+		}
+		index.AddBlock(r)
+		if maxID := int64(r.MaxID()); maxID > index.nextId {
+			index.nextId = maxID
+		}
+	}
+	return nil
+}
+
+func replaySegment(index *PostIndex, dir string, segment int) error {
+	f, err := os.Open(filepath.Join(dir, fmt.Sprintf("%08d%s", segment, walFileSuffix)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		length, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// A partial uvarint at EOF means the process crashed mid-write;
+			// stop replaying rather than treating it as corruption.
+			return nil
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil
+		}
+
+		var crc [4]byte
+		if _, err := io.ReadFull(r, crc[:]); err != nil {
+			return nil
+		}
+		if binary.BigEndian.Uint32(crc[:]) != crc32.ChecksumIEEE(payload) {
+			return nil
+		}
+
+		if err := applyRecord(index, payload); err != nil {
+			return err
+		}
+	}
+}
+
+func applyRecord(index *PostIndex, payload []byte) error {
+	recordType, payload := payload[0], payload[1:]
+	switch recordType {
+	case walRecordAdd:
+		count, n := binary.Uvarint(payload)
+		payload = payload[n:]
+
+		words := make([]string, count)
+		for i := range words {
+			wlen, n := binary.Uvarint(payload)
+			payload = payload[n:]
+			words[i] = string(payload[:wlen])
+			payload = payload[wlen:]
+		}
+		index.applyAddPost(words)
+	case walRecordDelete:
+		id, _ := binary.Uvarint(payload)
+		index.applyDeletePost(id)
+	default:
+		return fmt.Errorf("index: unknown WAL record type %d", recordType)
+	}
+	return nil
+}